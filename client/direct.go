@@ -27,7 +27,7 @@ func DirectInit(conn net.Conn, socketID string, conf *config.Config) (wrappers.R
 		return nil, nil, errors.Annotate(err, "Cannot extract frame")
 	}
 
-	obfs2, connOpts, err := obfuscated2.ParseObfuscated2ClientFrame(conf.Secret, frame)
+	obfs2, connOpts, err := parseObfuscated2AnySecret(conf, frame)
 	if err != nil {
 		return nil, nil, errors.Annotate(err, "Cannot parse obfuscated frame")
 	}
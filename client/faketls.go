@@ -0,0 +1,223 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/9seconds/mtg/config"
+	"github.com/9seconds/mtg/mtproto"
+	"github.com/9seconds/mtg/obfuscated2"
+	"github.com/9seconds/mtg/wrappers"
+)
+
+// fakeTLSClockSkew is how far the client_random timestamp may drift
+// from our own clock before we reject the ClientHello.
+const fakeTLSClockSkew = 3 * time.Second
+
+// FakeTLSInit initializes client connections that start with a TLS 1.3
+// ClientHello impersonating Config.FakeTLSHost. Once the fake handshake
+// completes, the rest of the connection is indistinguishable from the
+// legacy obfuscated2 preamble and is handed off to the same
+// obfuscated2.ExtractFrame/ParseObfuscated2ClientFrame path as
+// DirectInit.
+func FakeTLSInit(conn net.Conn, socketID string, conf *config.Config) (wrappers.ReadWriteCloserWithAddr, *mtproto.ConnectionOpts, error) {
+	if err := config.SetSocketOptions(conn); err != nil {
+		return nil, nil, errors.Annotate(err, "Cannot set socket options")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout)) // nolint: errcheck
+	clientHello, err := readTLSRecord(conn)
+	if err != nil {
+		conn.SetReadDeadline(time.Time{}) // nolint: errcheck
+		return nil, nil, errors.Annotate(err, "Cannot read ClientHello")
+	}
+
+	sessionID, randomOffset, err := parseClientHello(clientHello)
+	if err != nil {
+		conn.SetReadDeadline(time.Time{}) // nolint: errcheck
+		return nil, nil, errors.Annotate(err, "Cannot parse ClientHello")
+	}
+
+	if _, err := verifyClientHello(conf, clientHello, randomOffset); err != nil {
+		conn.SetReadDeadline(time.Time{}) // nolint: errcheck
+		return nil, nil, errors.Annotate(err, "Cannot verify ClientHello random")
+	}
+
+	if err := sendFakeHandshake(conn, sessionID); err != nil {
+		conn.SetReadDeadline(time.Time{}) // nolint: errcheck
+		return nil, nil, errors.Annotate(err, "Cannot send fake TLS handshake")
+	}
+	conn.SetReadDeadline(time.Time{}) // nolint: errcheck
+
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout)) // nolint: errcheck
+	frame, err := obfuscated2.ExtractFrame(conn)
+	conn.SetReadDeadline(time.Time{}) // nolint: errcheck
+	if err != nil {
+		return nil, nil, errors.Annotate(err, "Cannot extract frame")
+	}
+
+	obfs2, connOpts, err := parseObfuscated2AnySecret(conf, frame)
+	if err != nil {
+		return nil, nil, errors.Annotate(err, "Cannot parse obfuscated frame")
+	}
+	connOpts.ConnectionProto = mtproto.ConnectionProtocolAny
+	connOpts.ClientAddr = conn.RemoteAddr().(*net.TCPAddr)
+
+	socket := wrappers.NewTimeoutRWC(conn, socketID, conf.PublicIPv4, conf.PublicIPv6)
+	socket = wrappers.NewStreamCipherRWC(socket, obfs2.Encryptor, obfs2.Decryptor)
+
+	return socket, connOpts, nil
+}
+
+// readTLSRecord reads a single TLS record (5-byte header, big-endian
+// length) and returns its handshake payload.
+func readTLSRecord(conn net.Conn) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := readFull(conn, header); err != nil {
+		return nil, errors.Annotate(err, "Cannot read record header")
+	}
+
+	length := binary.BigEndian.Uint16(header[3:5])
+	payload := make([]byte, length)
+	if _, err := readFull(conn, payload); err != nil {
+		return nil, errors.Annotate(err, "Cannot read record payload")
+	}
+
+	return payload, nil
+}
+
+func readFull(conn net.Conn, buf []byte) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := conn.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+// parseClientHello extracts the session_id and the offset of the
+// 32-byte client_random from a ClientHello handshake body. The layout
+// follows RFC 8446 section 4.1.2: msg_type(1) + length(3) +
+// legacy_version(2) + random(32) + session_id_length(1) + session_id.
+func parseClientHello(body []byte) (sessionID []byte, randomOffset int, err error) {
+	const offset = 1 + 3 + 2
+	if len(body) < offset+32+1 {
+		return nil, 0, errors.New("ClientHello is too short")
+	}
+
+	sessionIDLen := int(body[offset+32])
+	sessionIDStart := offset + 32 + 1
+
+	if len(body) < sessionIDStart+sessionIDLen {
+		return nil, 0, errors.New("ClientHello session_id is truncated")
+	}
+	sessionID = body[sessionIDStart : sessionIDStart+sessionIDLen]
+
+	return sessionID, offset, nil
+}
+
+// verifyClientHello authenticates a FakeTLS ClientHello against
+// conf.Secrets and returns the secret that matched.
+//
+// A genuine FakeTLS client lays out the 32-byte client_random as: bytes
+// [0:20) real randomness, bytes [20:24) a unix timestamp, and bytes
+// [24:32) HMAC-SHA256(secret, clientHello-with-those-last-8-bytes-zeroed)
+// truncated to 8 bytes. That digest covers the ClientHello it rides in,
+// so, unlike a bare HMAC of the random itself, it cannot be produced
+// without the secret and cannot be replayed against a different
+// ClientHello. We check the timestamp first since it is cheap, then try
+// every configured secret's digest in turn.
+func verifyClientHello(conf *config.Config, clientHello []byte, randomOffset int) ([]byte, error) {
+	random := clientHello[randomOffset : randomOffset+32]
+
+	timestamp := int64(binary.BigEndian.Uint32(random[20:24]))
+	now := time.Now().Unix()
+	if timestamp < now-int64(fakeTLSClockSkew.Seconds()) || timestamp > now+int64(fakeTLSClockSkew.Seconds()) {
+		return nil, errors.New("client_random timestamp is outside the allowed clock skew")
+	}
+
+	digest := random[24:32]
+
+	zeroed := make([]byte, len(clientHello))
+	copy(zeroed, clientHello)
+	for i := range zeroed[randomOffset+24 : randomOffset+32] {
+		zeroed[randomOffset+24+i] = 0
+	}
+
+	for _, secret := range conf.Secrets {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(zeroed) // nolint: errcheck
+		expected := mac.Sum(nil)[:8]
+
+		if hmac.Equal(expected, digest) {
+			return secret, nil
+		}
+	}
+
+	return nil, errors.New("client_random digest does not match any configured secret")
+}
+
+// sendFakeHandshake writes a synthetic ServerHello (echoing sessionID),
+// a ChangeCipherSpec record and a single fake application-data record,
+// exactly what a real TLS 1.3 server would send before the encrypted
+// part of the handshake -- except here there is nothing encrypted
+// behind it, the obfuscated2 stream starts right after.
+func sendFakeHandshake(conn net.Conn, sessionID []byte) error {
+	serverHello := buildServerHello(sessionID)
+	if err := writeTLSRecord(conn, 0x16, serverHello); err != nil {
+		return errors.Annotate(err, "Cannot send ServerHello")
+	}
+
+	if err := writeTLSRecord(conn, 0x14, []byte{0x01}); err != nil {
+		return errors.Annotate(err, "Cannot send ChangeCipherSpec")
+	}
+
+	fakeAppData := make([]byte, 32+16) // arbitrary, looks like an encrypted EncryptedExtensions/Certificate record
+	if err := writeTLSRecord(conn, 0x17, fakeAppData); err != nil {
+		return errors.Annotate(err, "Cannot send fake application data")
+	}
+
+	return nil
+}
+
+func writeTLSRecord(conn net.Conn, contentType byte, payload []byte) error {
+	header := make([]byte, 5)
+	header[0] = contentType
+	header[1] = 0x03
+	header[2] = 0x03
+	binary.BigEndian.PutUint16(header[3:5], uint16(len(payload)))
+
+	if _, err := conn.Write(header); err != nil {
+		return err
+	}
+	_, err := conn.Write(payload)
+
+	return err
+}
+
+func buildServerHello(sessionID []byte) []byte {
+	body := make([]byte, 0, 2+32+1+len(sessionID)+2+1)
+	body = append(body, 0x03, 0x03) // legacy_version: TLS 1.2, as TLS 1.3 mandates
+	body = append(body, make([]byte, 32)...) // server_random, unused by the client
+	body = append(body, byte(len(sessionID)))
+	body = append(body, sessionID...)
+	body = append(body, 0x13, 0x01) // cipher_suite: TLS_AES_128_GCM_SHA256
+	body = append(body, 0x00)       // compression_method: null
+
+	handshake := make([]byte, 0, 4+len(body))
+	handshake = append(handshake, 0x02) // msg_type: ServerHello
+	length := len(body)
+	handshake = append(handshake, byte(length>>16), byte(length>>8), byte(length))
+	handshake = append(handshake, body...)
+
+	return handshake
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/9seconds/mtg/config"
+	"github.com/9seconds/mtg/mtproto"
+	"github.com/9seconds/mtg/remote"
+	"github.com/9seconds/mtg/wrappers"
+)
+
+var nonceCache = remote.NewNonceCache()
+
+// RemoteInit initializes a tunnel connection coming from a front-end mtg
+// node running in "remote proxy" mode. Unlike DirectInit/MiddleInit it
+// does not parse an obfuscated2 handshake: the client address and
+// mtproto.ConnectionOpts were already recovered by the front-end and are
+// carried verbatim in the tunnel's connect frame.
+func RemoteInit(conn net.Conn, socketID string, conf *config.Config) (wrappers.ReadWriteCloserWithAddr, *mtproto.ConnectionOpts, error) {
+	if err := config.SetSocketOptions(conn); err != nil {
+		return nil, nil, errors.Annotate(err, "Cannot set socket options")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout)) // nolint: errcheck
+	payload, err := remote.ReadFrame(conn)
+	conn.SetReadDeadline(time.Time{}) // nolint: errcheck
+	if err != nil {
+		return nil, nil, errors.Annotate(err, "Cannot read connect frame")
+	}
+
+	var frame remote.ConnectFrame
+	if err := json.Unmarshal(payload, &frame); err != nil {
+		return nil, nil, errors.Annotate(err, "Cannot parse connect frame")
+	}
+
+	if err := authenticate(frame, conf); err != nil {
+		return nil, nil, errors.Annotate(err, "Cannot authenticate remote tunnel")
+	}
+
+	connOpts := &mtproto.ConnectionOpts{}
+	if err := json.Unmarshal(frame.ConnOpts, connOpts); err != nil {
+		return nil, nil, errors.Annotate(err, "Cannot parse forwarded connection options")
+	}
+
+	socket := wrappers.NewTimeoutRWC(conn, socketID, conf.PublicIPv4, conf.PublicIPv6)
+
+	return socket, connOpts, nil
+}
+
+// authenticate checks frame against conf.RemoteListenKeys, the
+// credentials this back-end accepts from tunneling front-ends. This is
+// deliberately not conf.RemoteBackends: that list is what this node
+// would forward to if it were a front-end, a role a RemoteListen node
+// never plays.
+func authenticate(frame remote.ConnectFrame, conf *config.Config) error {
+	now := time.Now()
+
+	var lastErr error
+	for _, key := range conf.RemoteListenKeys {
+		if err := frame.Token.Verify(key.HMACKey, now); err != nil {
+			lastErr = err
+			continue
+		}
+		if key.BearerToken != "" && subtle.ConstantTimeCompare([]byte(frame.BearerToken), []byte(key.BearerToken)) != 1 {
+			lastErr = errors.New("remote bearer token mismatch")
+			continue
+		}
+		if !nonceCache.Seen(frame.Token.Nonce, now) {
+			return errors.New("remote token nonce has already been used")
+		}
+
+		return nil
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("no remote listen keys configured")
+	}
+
+	return lastErr
+}
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"github.com/juju/errors"
+
+	"github.com/9seconds/mtg/config"
+	"github.com/9seconds/mtg/mtproto"
+	"github.com/9seconds/mtg/obfuscated2"
+)
+
+// parseObfuscated2AnySecret tries every secret configured in conf.Secrets
+// against frame, in order, and returns the obfuscated2 stream together
+// with the ConnectionOpts recovered from whichever secret matched.
+// connOpts.SecretIndex is set to that secret's position in conf.Secrets
+// so callers can tag stats with which secret was used (see
+// proxy.Metrics.secretUsed).
+func parseObfuscated2AnySecret(conf *config.Config, frame []byte) (*obfuscated2.Obfuscated2, *mtproto.ConnectionOpts, error) {
+	var lastErr error
+
+	for i, secret := range conf.Secrets {
+		obfs2, connOpts, err := obfuscated2.ParseObfuscated2ClientFrame(secret, frame)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if !conf.MatchesSecret(secret) {
+			// Defensive: conf.Secrets is exactly what MatchesSecret checks
+			// against, so this can only happen if Secrets was mutated
+			// concurrently with no synchronization.
+			lastErr = errors.New("matched secret is no longer configured")
+			continue
+		}
+
+		connOpts.SecretIndex = i
+
+		return obfs2, connOpts, nil
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("no secrets are configured")
+	}
+
+	return nil, nil, errors.Annotate(lastErr, "Cannot parse obfuscated frame with any configured secret")
+}
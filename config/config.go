@@ -1,6 +1,7 @@
 package config
 
 import (
+	"crypto/hmac"
 	"encoding/hex"
 	"fmt"
 	"net"
@@ -31,8 +32,93 @@ type Config struct {
 	PublicIPv6 net.IP
 	StatsIP    net.IP
 
-	Secret []byte
-	AdTag  []byte
+	// Secret is the primary secret and is kept in sync with Secrets[0]
+	// for backwards compatibility; code that only knows about a single
+	// secret can keep reading it directly.
+	Secret  []byte
+	Secrets [][]byte
+
+	AdTag       []byte
+	FakeTLSHost string
+
+	RemoteBackends []RemoteBackend
+
+	// RemoteListen marks this node as a back-end in "remote proxy" mode:
+	// instead of terminating the obfuscated2/FakeTLS client handshake,
+	// it accepts tunnel connections from front-end nodes over TLS and
+	// reconstructs mtproto.ConnectionOpts from the tunnel frame.
+	RemoteListen         bool
+	RemoteListenCertFile string
+	RemoteListenKeyFile  string
+
+	// RemoteListenKeys are the credentials a back-end node accepts from
+	// front-ends tunneling into it. This is deliberately a separate list
+	// from RemoteBackends: RemoteBackends is what a front-end forwards
+	// to, and newTelegram ignores it when RemoteListen is set, so a
+	// back-end terminates forwarded connections itself.
+	RemoteListenKeys []RemoteListenKey
+
+	ProxyProtocol  bool
+	TrustedProxies []*net.IPNet
+
+	MaxConnectionsPerIP         int
+	MaxHandshakesPerMinutePerIP int
+	MaxConnectionsPerASN        int
+	GeoIPDatabase               string
+	BlockedCountries            []string
+	AllowedCountries            []string
+}
+
+// RemoteBackend describes a back-end mtg node that holds the ad-tag and
+// middleproxy credentials. A front-end node in "remote proxy" mode
+// forwards the decrypted MTPROTO stream to one of these over an
+// authenticated TLS tunnel instead of dialing Telegram directly.
+type RemoteBackend struct {
+	URL         string
+	HMACKey     []byte
+	BearerToken string
+}
+
+// RemoteListenKey is one credential a back-end node, running with
+// RemoteListen set, accepts from a tunneling front-end.
+type RemoteListenKey struct {
+	HMACKey     []byte
+	BearerToken string
+}
+
+// NewRemoteListenKey builds a RemoteListenKey from its CLI/config
+// representation, mirroring NewRemoteBackend's parsing of the same
+// hex-encoded HMAC key and optional bearer token.
+func NewRemoteListenKey(hmacKey, bearerToken string) (RemoteListenKey, error) {
+	keyBytes, err := hex.DecodeString(hmacKey)
+	if err != nil {
+		return RemoteListenKey{}, errors.Annotate(err, "Cannot decode remote listen HMAC key")
+	}
+	if len(keyBytes) == 0 {
+		return RemoteListenKey{}, errors.New("remote listen key requires a non-empty HMAC key")
+	}
+
+	return RemoteListenKey{HMACKey: keyBytes, BearerToken: bearerToken}, nil
+}
+
+// NewRemoteBackend builds a RemoteBackend from its CLI/config
+// representation. hmacKey is a hex-encoded shared secret used to sign
+// forwarding tokens; bearerToken is optional and, when set, is sent
+// alongside the signed token during the tunnel handshake.
+func NewRemoteBackend(url, hmacKey, bearerToken string) (RemoteBackend, error) {
+	keyBytes, err := hex.DecodeString(hmacKey)
+	if err != nil {
+		return RemoteBackend{}, errors.Annotate(err, "Cannot decode remote backend HMAC key")
+	}
+	if len(keyBytes) == 0 {
+		return RemoteBackend{}, errors.New("remote backend requires a non-empty HMAC key")
+	}
+
+	return RemoteBackend{
+		URL:         url,
+		HMACKey:     keyBytes,
+		BearerToken: bearerToken,
+	}, nil
 }
 
 // URLs contains links to the proxy (tg://, t.me) and their QR codes.
@@ -65,19 +151,76 @@ func (c *Config) UseMiddleProxy() bool {
 	return len(c.AdTag) > 0
 }
 
+// IsTrustedProxy defines if ip is allowed to prepend a PROXY protocol
+// header to its connections. It has no effect unless ProxyProtocol is
+// enabled.
+func (c *Config) IsTrustedProxy(ip net.IP) bool {
+	for _, network := range c.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsFakeTLS defines if this proxy serves an `ee`-prefixed FakeTLS
+// secret, in which case connections start with a TLS 1.3-looking
+// ClientHello instead of the legacy obfuscated2 preamble.
+func (c *Config) IsFakeTLS() bool {
+	return len(c.FakeTLSHost) > 0
+}
+
+// UseRateLimiting defines if connection/handshake quotas have to be
+// enforced before the (expensive) obfuscated2 handshake runs.
+func (c *Config) UseRateLimiting() bool {
+	return c.MaxConnectionsPerIP > 0 || c.MaxHandshakesPerMinutePerIP > 0 || c.MaxConnectionsPerASN > 0
+}
+
+// UseGeoIP defines if connections have to be filtered by country using
+// the configured MaxMind database.
+func (c *Config) UseGeoIP() bool {
+	return c.GeoIPDatabase != "" && (len(c.BlockedCountries) > 0 || len(c.AllowedCountries) > 0)
+}
+
+// UseRemoteBackends defines if this proxy has to run in "remote proxy"
+// mode, forwarding the decrypted MTPROTO stream to back-end nodes
+// instead of dialing Telegram directly.
+func (c *Config) UseRemoteBackends() bool {
+	return len(c.RemoteBackends) > 0
+}
+
 // GetURLs returns configured IPURLs instance with links to this server.
 func (c *Config) GetURLs() IPURLs {
 	urls := IPURLs{}
+	secret := c.urlSecret()
+
 	if c.PublicIPv4 != nil {
-		urls.IPv4 = getURLs(c.PublicIPv4, c.PublicIPv4Port, c.Secret)
+		urls.IPv4 = getURLs(c.PublicIPv4, c.PublicIPv4Port, secret)
 	}
 	if c.PublicIPv6 != nil {
-		urls.IPv6 = getURLs(c.PublicIPv6, c.PublicIPv6Port, c.Secret)
+		urls.IPv6 = getURLs(c.PublicIPv6, c.PublicIPv6Port, secret)
 	}
 
 	return urls
 }
 
+// urlSecret returns the secret to embed into tg:// links: the raw
+// secret for the legacy obfuscated2 format, or an `ee`-prefixed secret
+// with FakeTLSHost appended when this proxy serves FakeTLS.
+func (c *Config) urlSecret() []byte {
+	if !c.IsFakeTLS() {
+		return c.Secret
+	}
+
+	secret := make([]byte, 0, 1+len(c.Secret)+len(c.FakeTLSHost))
+	secret = append(secret, 0xee)
+	secret = append(secret, c.Secret...)
+	secret = append(secret, []byte(c.FakeTLSHost)...)
+
+	return secret
+}
+
 func getAddr(host fmt.Stringer, port uint16) string {
 	return net.JoinHostPort(host.String(), strconv.Itoa(int(port)))
 }
@@ -91,11 +234,7 @@ func NewConfig(debug, verbose bool, // nolint: gocyclo
 	publicIPv6 net.IP, publicIPv6Port uint16,
 	statsIP net.IP, statsPort uint16,
 	secret, adtag string) (*Config, error) {
-	secret = strings.TrimPrefix(secret, "dd")
-	if len(secret) != 32 {
-		return nil, errors.New("Telegram demands secret of length 32")
-	}
-	secretBytes, err := hex.DecodeString(secret)
+	secretBytes, fakeTLSHost, err := parseSecret(secret)
 	if err != nil {
 		return nil, errors.Annotate(err, "Cannot create config")
 	}
@@ -148,8 +287,67 @@ func NewConfig(debug, verbose bool, // nolint: gocyclo
 		StatsIP:        statsIP,
 		StatsPort:      statsPort,
 		Secret:         secretBytes,
+		Secrets:        [][]byte{secretBytes},
 		AdTag:          adTagBytes,
+		FakeTLSHost:    fakeTLSHost,
 	}
 
 	return conf, nil
 }
+
+// SetSecrets replaces the set of secrets this proxy accepts, keeping
+// Secret as an alias for secrets[0] so callers that only know about a
+// single secret keep working. It is used to rotate or add secrets on
+// SIGHUP without restarting the process.
+func (c *Config) SetSecrets(secrets [][]byte) error {
+	if len(secrets) == 0 {
+		return errors.New("at least one secret is required")
+	}
+
+	c.Secrets = secrets
+	c.Secret = secrets[0]
+
+	return nil
+}
+
+// MatchesSecret reports whether candidate is one of the secrets this
+// proxy currently accepts.
+func (c *Config) MatchesSecret(candidate []byte) bool {
+	for _, secret := range c.Secrets {
+		if hmac.Equal(secret, candidate) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseSecret decodes the CLI/env secret, which is either a legacy
+// `dd`-prefixed (or bare) 16-byte secret, or an `ee`-prefixed FakeTLS
+// secret carrying the 16-byte secret followed by the SNI host to
+// impersonate.
+func parseSecret(secret string) ([]byte, string, error) {
+	if strings.HasPrefix(secret, "ee") {
+		raw, err := hex.DecodeString(secret)
+		if err != nil {
+			return nil, "", errors.Annotate(err, "Cannot decode FakeTLS secret")
+		}
+		if len(raw) <= 17 {
+			return nil, "", errors.New("FakeTLS secret must carry a domain after the 16-byte key")
+		}
+
+		return raw[1:17], string(raw[17:]), nil
+	}
+
+	secret = strings.TrimPrefix(secret, "dd")
+	if len(secret) != 32 {
+		return nil, "", errors.New("Telegram demands secret of length 32")
+	}
+
+	secretBytes, err := hex.DecodeString(secret)
+	if err != nil {
+		return nil, "", errors.Annotate(err, "Cannot create config")
+	}
+
+	return secretBytes, "", nil
+}
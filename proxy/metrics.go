@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics keeps Prometheus/OpenMetrics collectors for a running proxy
+// instance. It is independent of Stats (which feeds the legacy JSON
+// endpoint) so either can be wired up without the other.
+type Metrics struct {
+	connectionsTotal     *prometheus.CounterVec
+	activeConnections    prometheus.Gauge
+	trafficBytesTotal    *prometheus.CounterVec
+	handshakeFailures    *prometheus.CounterVec
+	telegramDialDuration prometheus.Histogram
+	dcConnections        *prometheus.GaugeVec
+	secretUsageTotal     *prometheus.CounterVec
+}
+
+// NewMetrics creates and registers the mtg collectors against the given
+// registry. Callers in main are expected to pass prometheus.DefaultRegisterer.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		connectionsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mtg_connections_total",
+			Help: "Total number of accepted connections.",
+		}, []string{"proto", "direction"}),
+		activeConnections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "mtg_active_connections",
+			Help: "Number of currently active client connections.",
+		}),
+		trafficBytesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mtg_traffic_bytes_total",
+			Help: "Total bytes proxied.",
+		}, []string{"direction"}),
+		handshakeFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mtg_handshake_failures_total",
+			Help: "Total number of failed handshakes, labeled by the stage that rejected them.",
+		}, []string{"reason"}),
+		telegramDialDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "mtg_telegram_dial_duration_seconds",
+			Help:    "Time spent dialing a Telegram datacenter.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		dcConnections: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "mtg_dc_connections",
+			Help: "Number of active connections per Telegram datacenter.",
+		}, []string{"dc"}),
+		secretUsageTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mtg_secret_usage_total",
+			Help: "Total number of client connections matched per configured secret, labeled by its index in Secrets.",
+		}, []string{"secret_index"}),
+	}
+
+	reg.MustRegister(
+		m.connectionsTotal,
+		m.activeConnections,
+		m.trafficBytesTotal,
+		m.handshakeFailures,
+		m.telegramDialDuration,
+		m.dcConnections,
+		m.secretUsageTotal,
+	)
+
+	return m
+}
+
+func (m *Metrics) connectionOpened() {
+	m.connectionsTotal.WithLabelValues("mtproto", "in").Inc()
+	m.activeConnections.Inc()
+}
+
+func (m *Metrics) connectionClosed(dc int) {
+	m.activeConnections.Dec()
+	if dc != 0 {
+		m.dcConnections.WithLabelValues(strconv.Itoa(dc)).Dec()
+	}
+}
+
+func (m *Metrics) dcConnectionOpened(dc int) {
+	m.dcConnections.WithLabelValues(strconv.Itoa(dc)).Inc()
+}
+
+func (m *Metrics) secretUsed(index int) {
+	m.secretUsageTotal.WithLabelValues(strconv.Itoa(index)).Inc()
+}
+
+func (m *Metrics) addIncomingTraffic(n int) {
+	m.trafficBytesTotal.WithLabelValues("in").Add(float64(n))
+}
+
+func (m *Metrics) addOutgoingTraffic(n int) {
+	m.trafficBytesTotal.WithLabelValues("out").Add(float64(n))
+}
+
+func (m *Metrics) handshakeFailed(reason string) {
+	m.handshakeFailures.WithLabelValues(reason).Inc()
+}
+
+func (m *Metrics) observeTelegramDial(d time.Duration) {
+	m.telegramDialDuration.Observe(d.Seconds())
+}
+
+// Handler returns the http.Handler to serve on config.StatAddr() next to
+// the existing JSON stats endpoint.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.Handler()
+}
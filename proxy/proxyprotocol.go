@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// proxyProtocolReadTimeout bounds how long we wait for a PROXY protocol
+// header so an untrusted peer cannot stall an accept goroutine.
+const proxyProtocolReadTimeout = 2 * time.Second
+
+// proxyProtocolV1MaxLen is the hard cap on a v1 text header, matching
+// the limit from the PROXY protocol specification.
+const proxyProtocolV1MaxLen = 108
+
+var proxyProtocolV2Signature = []byte{
+	0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A,
+}
+
+// readProxyProtocolHeader reads and parses a PROXY protocol v1 or v2
+// header from conn and returns a conn to keep using (with any bytes
+// the parser buffered ahead of the header preserved) together with the
+// client address the header carries. A conn carrying the LOCAL command
+// (v2) or "PROXY UNKNOWN" (v1) is treated as having no usable client
+// info: the returned *net.TCPAddr is nil.
+func readProxyProtocolHeader(conn net.Conn) (net.Conn, *net.TCPAddr, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyProtocolReadTimeout)) // nolint: errcheck
+	defer conn.SetReadDeadline(time.Time{})                        // nolint: errcheck
+
+	reader := bufio.NewReader(conn)
+	wrapped := &bufferedConn{Conn: conn, reader: reader}
+
+	sig, err := reader.Peek(len(proxyProtocolV2Signature))
+	if err == nil && bytesEqual(sig, proxyProtocolV2Signature) {
+		addr, err := readProxyProtocolV2(reader)
+		return wrapped, addr, err
+	}
+
+	addr, err := readProxyProtocolV1(reader)
+
+	return wrapped, addr, err
+}
+
+// bufferedConn is a net.Conn whose Read is served from a bufio.Reader so
+// that bytes buffered ahead of a parsed PROXY protocol header are not
+// lost once the raw connection is handed off to clientInit.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// readLimitedLine reads up to and including a '\n' from reader, reading
+// one byte at a time so the accumulation itself is bounded by maxLen
+// rather than relying on bufio.Reader.ReadString, which keeps buffering
+// until it sees a newline no matter how long the line is.
+func readLimitedLine(reader *bufio.Reader, maxLen int) (string, error) {
+	buf := make([]byte, 0, maxLen)
+
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return "", errors.Annotate(err, "Cannot read PROXY v1 header")
+		}
+
+		buf = append(buf, b)
+		if b == '\n' {
+			return string(buf), nil
+		}
+		if len(buf) >= maxLen {
+			return "", errors.New("PROXY v1 header exceeds 108 bytes")
+		}
+	}
+}
+
+func readProxyProtocolV1(reader *bufio.Reader) (*net.TCPAddr, error) {
+	line, err := readLimitedLine(reader, proxyProtocolV1MaxLen)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "PROXY ") {
+		return nil, errors.New("not a PROXY v1 header")
+	}
+
+	fields := strings.Fields(strings.TrimRight(line, "\r\n"))
+	if len(fields) < 2 {
+		return nil, errors.New("malformed PROXY v1 header")
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return nil, errors.New("malformed PROXY v1 TCP header")
+		}
+
+		port, err := strconv.Atoi(fields[4])
+		if err != nil {
+			return nil, errors.Annotate(err, "Cannot parse PROXY v1 source port")
+		}
+
+		ip := net.ParseIP(fields[2])
+		if ip == nil {
+			return nil, errors.Errorf("cannot parse PROXY v1 source address %s", fields[2])
+		}
+
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	default:
+		return nil, errors.Errorf("unknown PROXY v1 protocol family %s", fields[1])
+	}
+}
+
+func readProxyProtocolV2(reader *bufio.Reader) (*net.TCPAddr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, errors.Annotate(err, "Cannot read PROXY v2 header")
+	}
+
+	versionCommand := header[12]
+	if versionCommand>>4 != 2 {
+		return nil, errors.New("unsupported PROXY protocol version")
+	}
+	command := versionCommand & 0x0F
+
+	family := header[13] >> 4
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	addr := make([]byte, length)
+	if _, err := io.ReadFull(reader, addr); err != nil {
+		return nil, errors.Annotate(err, "Cannot read PROXY v2 address block")
+	}
+
+	if command == 0x00 { // LOCAL
+		return nil, nil
+	}
+	if command != 0x01 { // only PROXY is meaningful here
+		return nil, errors.Errorf("unsupported PROXY v2 command %d", command)
+	}
+
+	switch family {
+	case 1: // AF_INET
+		if len(addr) < 12 {
+			return nil, errors.New("PROXY v2 TCP4 address block too short")
+		}
+
+		port := binary.BigEndian.Uint16(addr[8:10])
+
+		return &net.TCPAddr{IP: net.IP(addr[0:4]), Port: int(port)}, nil
+	case 2: // AF_INET6
+		if len(addr) < 36 {
+			return nil, errors.New("PROXY v2 TCP6 address block too short")
+		}
+
+		port := binary.BigEndian.Uint16(addr[32:34])
+
+		return &net.TCPAddr{IP: net.IP(addr[0:16]), Port: int(port)}, nil
+	default:
+		return nil, errors.Errorf("unsupported PROXY v2 address family %d", family)
+	}
+}
+
+func bytesEqual(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
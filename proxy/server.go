@@ -2,9 +2,12 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/juju/errors"
 	uuid "github.com/satori/go.uuid"
@@ -13,6 +16,7 @@ import (
 	"github.com/9seconds/mtg/client"
 	"github.com/9seconds/mtg/config"
 	"github.com/9seconds/mtg/mtproto"
+	"github.com/9seconds/mtg/ratelimit"
 	"github.com/9seconds/mtg/telegram"
 	"github.com/9seconds/mtg/utils"
 	"github.com/9seconds/mtg/wrappers"
@@ -20,23 +24,104 @@ import (
 
 // Server is an insgtance of MTPROTO proxy.
 type Server struct {
-	conf       *config.Config
+	conf     *config.Config
+	confBind atomic.Value // holds *config.Config; read by accept, getClientStream
+	tgBind   atomic.Value // holds *telegramHolder; read by getTelegramStream
+
 	logger     *zap.SugaredLogger
 	stats      *Stats
-	tg         telegram.Telegram
+	metrics    *Metrics
+	limiter    *ratelimit.Limiter
 	clientInit client.Init
 }
 
+// telegramHolder boxes a telegram.Telegram so it can live in an
+// atomic.Value: successive Reload calls may pick different concrete
+// implementations (direct/middle/remote), and atomic.Value requires
+// every Store to use the same concrete type.
+type telegramHolder struct {
+	tg telegram.Telegram
+}
+
+// currentConf returns the config in effect for new connections, which
+// Reload can swap out without disturbing connections already being
+// served.
+func (s *Server) currentConf() *config.Config {
+	return s.confBind.Load().(*config.Config)
+}
+
+// currentTelegram returns the telegram.Telegram in effect for new
+// connections.
+func (s *Server) currentTelegram() telegram.Telegram {
+	return s.tgBind.Load().(*telegramHolder).tg
+}
+
+// Reload swaps in newConf for all new connections. Connections already
+// being served keep running against the config and Telegram transport
+// they started with. It re-derives the Telegram transport (so AdTag
+// rotation between direct/middle/remote takes effect) and the rate
+// limiter's quotas/GeoIP database. BindAddr must stay the same since
+// the listening socket is not recreated.
+func (s *Server) Reload(newConf *config.Config) error {
+	if newConf.BindAddr() != s.conf.BindAddr() {
+		return errors.New("cannot change bind address on reload")
+	}
+
+	if s.limiter != nil {
+		if err := s.limiter.Reload(newConf); err != nil {
+			return errors.Annotate(err, "Cannot reload rate limiter")
+		}
+	}
+
+	s.tgBind.Store(&telegramHolder{tg: newTelegram(newConf, s.logger)})
+	s.confBind.Store(newConf)
+
+	return nil
+}
+
+// newTelegram picks the Telegram transport matching conf, mirroring the
+// selection NewServer does at startup so Reload can re-derive it when
+// AdTag or RemoteBackends change.
+//
+// A RemoteListen node must never pick NewRemoteTelegram: it is the
+// back-end other nodes forward to, so it has to dial Telegram itself
+// (directly or via middleproxy) once RemoteInit hands it a forwarded
+// connection, not forward the connection again.
+func newTelegram(conf *config.Config, logger *zap.SugaredLogger) telegram.Telegram {
+	tg := telegram.NewDirectTelegram
+
+	if len(conf.AdTag) > 0 {
+		tg = telegram.NewMiddleTelegram
+	}
+	if !conf.RemoteListen && conf.UseRemoteBackends() {
+		tg = telegram.NewRemoteTelegram
+	}
+
+	return tg(conf, logger)
+}
+
 // Serve does MTPROTO proxying.
 func (s *Server) Serve() error {
-	lsock, err := net.Listen("tcp", s.conf.BindAddr())
+	var lsock net.Listener
+	var err error
+
+	if s.conf.RemoteListen {
+		cert, certErr := tls.LoadX509KeyPair(s.conf.RemoteListenCertFile, s.conf.RemoteListenKeyFile)
+		if certErr != nil {
+			return errors.Annotate(certErr, "Cannot load remote listener TLS certificate")
+		}
+
+		lsock, err = tls.Listen("tcp", s.conf.BindAddr(), &tls.Config{Certificates: []tls.Certificate{cert}})
+	} else {
+		lsock, err = net.Listen("tcp", s.conf.BindAddr())
+	}
 	if err != nil {
 		return errors.Annotate(err, "Cannot create listen socket")
 	}
 
 	for {
 		if conn, err := lsock.Accept(); err != nil {
-			s.logger.Warn("Cannot allocate incoming connection", "error", err)
+			s.logger.Desugar().Warn("Cannot allocate incoming connection", zap.Error(err))
 		} else {
 			go s.accept(conn)
 		}
@@ -44,45 +129,107 @@ func (s *Server) Serve() error {
 }
 
 func (s *Server) accept(conn net.Conn) {
+	var dc int
+	conf := s.currentConf()
+
 	defer func() {
 		s.stats.closeConnection()
+		s.metrics.connectionClosed(dc)
 		conn.Close() // nolint: errcheck
 
 		if r := recover(); r != nil {
-			s.logger.Errorw("Crash of accept handler", "error", r)
+			s.logger.Desugar().Error("Crash of accept handler", zap.Any("error", r))
 		}
 	}()
 
 	s.stats.newConnection()
+	s.metrics.connectionOpened()
 	ctx, cancel := context.WithCancel(context.Background())
 	socketID := uuid.NewV4().String()
 
-	s.logger.Debugw("Client connected",
-		"addr", conn.RemoteAddr().String(),
-		"socketid", socketID,
+	var realClientAddr *net.TCPAddr
+	if conf.ProxyProtocol {
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && conf.IsTrustedProxy(tcpAddr.IP) {
+			wrapped, addr, err := readProxyProtocolHeader(conn)
+			if err != nil {
+				s.metrics.handshakeFailed("proxy_protocol")
+				s.logger.Desugar().Warn("Cannot parse PROXY protocol header",
+					zap.String("addr", conn.RemoteAddr().String()),
+					zap.String("socketid", socketID),
+					zap.Error(err),
+				)
+				return
+			}
+			conn, realClientAddr = wrapped, addr
+		}
+	}
+
+	rateLimitAddr := conn.RemoteAddr().(*net.TCPAddr)
+	if realClientAddr != nil {
+		rateLimitAddr = realClientAddr
+	}
+
+	if s.limiter != nil {
+		if ok, reason := s.limiter.Allow(rateLimitAddr.IP); !ok {
+			s.metrics.handshakeFailed(reason)
+			s.logger.Desugar().Debug("Connection rejected by rate limiter",
+				zap.String("addr", rateLimitAddr.String()),
+				zap.String("socketid", socketID),
+				zap.String("reason", reason),
+			)
+			return
+		}
+
+		if delay := s.limiter.Delay(rateLimitAddr.IP); delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+
+	s.logger.Desugar().Debug("Client connected",
+		zap.String("addr", conn.RemoteAddr().String()),
+		zap.String("socketid", socketID),
 	)
 
 	connOpts, clientConn, err := s.getClientStream(ctx, cancel, conn, socketID)
 	if err != nil {
-		s.logger.Warnw("Cannot initialize client connection",
-			"addr", conn.RemoteAddr().String(),
-			"socketid", socketID,
-			"error", err,
+		s.metrics.handshakeFailed("client")
+		if s.limiter != nil {
+			s.limiter.HandshakeFailed(rateLimitAddr.IP)
+		}
+		s.logger.Desugar().Warn("Cannot initialize client connection",
+			zap.String("addr", conn.RemoteAddr().String()),
+			zap.String("socketid", socketID),
+			zap.Error(err),
 		)
 		return
 	}
 	defer clientConn.Close() // nolint: errcheck
 
+	if s.limiter != nil {
+		s.limiter.HandshakeSucceeded(rateLimitAddr.IP)
+	}
+
+	if realClientAddr != nil {
+		connOpts.ClientAddr = realClientAddr
+	}
+
 	tgConn, err := s.getTelegramStream(ctx, cancel, connOpts, socketID)
 	if err != nil {
-		s.logger.Warnw("Cannot initialize Telegram connection",
-			"socketid", socketID,
-			"error", err,
+		s.metrics.handshakeFailed("telegram")
+		s.logger.Desugar().Warn("Cannot initialize Telegram connection",
+			zap.String("socketid", socketID),
+			zap.Error(err),
 		)
 		return
 	}
 	defer tgConn.Close() // nolint: errcheck
 
+	// Only set dc once the Telegram connection for it is actually open,
+	// so the deferred connectionClosed(dc) above never decrements a DC
+	// gauge that dcConnectionOpened never incremented.
+	dc = connOpts.DC
+	s.metrics.dcConnectionOpened(dc)
+
 	wait := &sync.WaitGroup{}
 	wait.Add(2)
 
@@ -93,8 +240,8 @@ func (s *Server) accept(conn net.Conn) {
 			connOpts.ReadHacks.QuickAck = false
 			connOpts.ReadHacks.SimpleAck = false
 			if err := s.pump(clientConn, tgConn, socketID, "client"); err != nil {
-				s.logger.Infow("Client stream is aborted",
-					"socketid", socketID, "error", err)
+				s.logger.Desugar().Info("Client stream is aborted",
+					zap.String("socketid", socketID), zap.Error(err))
 				return
 			}
 		}
@@ -106,8 +253,8 @@ func (s *Server) accept(conn net.Conn) {
 			connOpts.WriteHacks.QuickAck = false
 			connOpts.WriteHacks.SimpleAck = false
 			if err := s.pump(tgConn, clientConn, socketID, "telegram"); err != nil {
-				s.logger.Infow("Telegram stream is aborted",
-					"socketid", socketID, "error", err)
+				s.logger.Desugar().Info("Telegram stream is aborted",
+					zap.String("socketid", socketID), zap.Error(err))
 				return
 			}
 		}
@@ -116,19 +263,21 @@ func (s *Server) accept(conn net.Conn) {
 	<-ctx.Done()
 	wait.Wait()
 
-	s.logger.Debugw("Client disconnected",
-		"addr", conn.RemoteAddr().String(),
-		"socketid", socketID,
+	s.logger.Desugar().Debug("Client disconnected",
+		zap.String("addr", conn.RemoteAddr().String()),
+		zap.String("socketid", socketID),
 	)
 }
 
 func (s *Server) getClientStream(ctx context.Context, cancel context.CancelFunc, conn net.Conn, socketID string) (*mtproto.ConnectionOpts, io.ReadWriteCloser, error) {
-	socket, connOpts, err := s.clientInit(conn, socketID, s.conf)
+	socket, connOpts, err := s.clientInit(conn, socketID, s.currentConf())
 	if err != nil {
 		return nil, nil, errors.Annotate(err, "Cannot init client connection")
 	}
+	s.metrics.secretUsed(connOpts.SecretIndex)
 
 	socket = wrappers.NewTrafficRWC(socket, s.stats.addIncomingTraffic, s.stats.addOutgoingTraffic)
+	socket = wrappers.NewTrafficRWC(socket, s.metrics.addIncomingTraffic, s.metrics.addOutgoingTraffic)
 	socket = wrappers.NewLogRWC(socket, s.logger, socketID, "client")
 	socket = wrappers.NewCtxRWC(ctx, cancel, socket)
 
@@ -136,13 +285,18 @@ func (s *Server) getClientStream(ctx context.Context, cancel context.CancelFunc,
 }
 
 func (s *Server) getTelegramStream(ctx context.Context, cancel context.CancelFunc, connOpts *mtproto.ConnectionOpts, socketID string) (io.ReadWriteCloser, error) {
-	conn, err := s.tg.Dial(socketID, connOpts)
+	tg := s.currentTelegram()
+
+	dialStart := time.Now()
+	conn, err := tg.Dial(socketID, connOpts)
+	s.metrics.observeTelegramDial(time.Since(dialStart))
 	if err != nil {
 		return nil, errors.Annotate(err, "Cannot connect to Telegram")
 	}
 
 	conn = wrappers.NewTrafficRWC(conn, s.stats.addIncomingTraffic, s.stats.addOutgoingTraffic)
-	conn, err = s.tg.Init(connOpts, conn)
+	conn = wrappers.NewTrafficRWC(conn, s.metrics.addIncomingTraffic, s.metrics.addOutgoingTraffic)
+	conn, err = tg.Init(connOpts, conn)
 	if err != nil {
 		return nil, errors.Annotate(err, "Cannot handshake Telegram")
 	}
@@ -164,21 +318,36 @@ func (s *Server) pump(src io.Reader, dst io.Writer, socketID, name string) error
 	return err
 }
 
-// NewServer creates new instance of MTPROTO proxy.
-func NewServer(conf *config.Config, logger *zap.SugaredLogger, stat *Stats) *Server {
+// NewServer creates new instance of MTPROTO proxy. limiter may be nil
+// when conf does not configure any rate limiting or GeoIP policy.
+func NewServer(conf *config.Config, logger *zap.SugaredLogger, stat *Stats, metrics *Metrics, limiter *ratelimit.Limiter) *Server {
 	clientInit := client.DirectInit
-	tg := telegram.NewDirectTelegram
 
 	if len(conf.AdTag) > 0 {
 		clientInit = client.MiddleInit
-		tg = telegram.NewMiddleTelegram
 	}
 
-	return &Server{
+	if conf.IsFakeTLS() {
+		clientInit = client.FakeTLSInit
+	}
+
+	if conf.RemoteListen {
+		// Back-end node: the client handshake already happened on the
+		// front-end, so skip straight to reconstructing ConnectionOpts
+		// from the tunnel frame.
+		clientInit = client.RemoteInit
+	}
+
+	server := &Server{
 		conf:       conf,
 		logger:     logger,
 		stats:      stat,
-		tg:         tg(conf, logger),
+		metrics:    metrics,
+		limiter:    limiter,
 		clientInit: clientInit,
 	}
+	server.confBind.Store(conf)
+	server.tgBind.Store(&telegramHolder{tg: newTelegram(conf, logger)})
+
+	return server
 }
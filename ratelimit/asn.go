@@ -0,0 +1,24 @@
+package ratelimit
+
+import "strconv"
+
+// ASNBuckets is a collection of token buckets keyed directly by ASN
+// number. It exists separately from Buckets because ASNs do not fit the
+// IP-prefix key space: packing an ASN into a synthetic net.IP and
+// running it through prefixKey's /24 mask would zero its low bits and
+// collide unrelated ASNs (e.g. AS15169 and AS15170) onto the same
+// bucket.
+type ASNBuckets struct {
+	shards *bucketShards
+}
+
+// NewASNBuckets creates an ASNBuckets instance where each ASN may take
+// up to capacity connections, refilling at refillPerMinute tokens/minute.
+func NewASNBuckets(capacity int, refillPerMinute int) *ASNBuckets {
+	return &ASNBuckets{shards: newBucketShards(capacity, refillPerMinute)}
+}
+
+// Allow reports whether a connection from asn should be let through.
+func (b *ASNBuckets) Allow(asn uint) bool {
+	return b.shards.allow(strconv.FormatUint(uint64(asn), 10))
+}
@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	backoffCacheSize = 4096
+	backoffBase      = 200 * time.Millisecond
+	backoffMax       = 5 * time.Second
+
+	// backoffMaxStrikes caps entry.strikes well below the point where
+	// 1<<uint(strikes-1) would overflow int64 and wrap to a negative
+	// shift amount. backoffBase*2^(backoffMaxStrikes-1) already dwarfs
+	// backoffMax, so the clamp below never actually changes behavior for
+	// a source that is still backing off -- it only stops strikes from
+	// growing forever on a source that keeps failing and keeps getting
+	// touched back to the front of the LRU.
+	backoffMaxStrikes = 32
+)
+
+// FailureBackoff remembers sources whose handshake recently failed and
+// hands back an increasing delay for each subsequent attempt, so
+// scanners get progressively slower responses instead of an instant
+// rejection they can retry against at full speed.
+type FailureBackoff struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type backoffEntry struct {
+	key     string
+	strikes int
+}
+
+// NewFailureBackoff creates an empty FailureBackoff.
+func NewFailureBackoff() *FailureBackoff {
+	return &FailureBackoff{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Fail records a failed handshake from ip and returns the delay the
+// caller should wait before responding to its next attempt.
+func (f *FailureBackoff) Fail(ip net.IP) time.Duration {
+	key := ip.String()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var entry *backoffEntry
+	if elem, ok := f.entries[key]; ok {
+		entry = elem.Value.(*backoffEntry)
+		if entry.strikes < backoffMaxStrikes {
+			entry.strikes++
+		}
+		f.order.MoveToFront(elem)
+	} else {
+		entry = &backoffEntry{key: key, strikes: 1}
+		f.entries[key] = f.order.PushFront(entry)
+		f.evictLocked()
+	}
+
+	delay := backoffBase * time.Duration(1<<uint(entry.strikes-1))
+	if delay > backoffMax {
+		delay = backoffMax
+	}
+
+	return delay
+}
+
+// Forget clears any recorded failures for ip, e.g. after a successful
+// handshake.
+func (f *FailureBackoff) Forget(ip net.IP) {
+	key := ip.String()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if elem, ok := f.entries[key]; ok {
+		f.order.Remove(elem)
+		delete(f.entries, key)
+	}
+}
+
+func (f *FailureBackoff) evictLocked() {
+	for len(f.entries) > backoffCacheSize {
+		oldest := f.order.Back()
+		if oldest == nil {
+			return
+		}
+
+		f.order.Remove(oldest)
+		delete(f.entries, oldest.Value.(*backoffEntry).key)
+	}
+}
@@ -0,0 +1,34 @@
+package ratelimit
+
+import (
+	"net"
+	"testing"
+)
+
+// TestFailureBackoffManyStrikesDoesNotOverflow guards against
+// entry.strikes growing past the point where 1<<uint(strikes-1)
+// overflows int64: a source that keeps failing (and so keeps getting
+// touched back to the front of the LRU, never evicted) must still get
+// an increasing delay up to backoffMax, never a wrapped-around zero or
+// negative one.
+func TestFailureBackoffManyStrikesDoesNotOverflow(t *testing.T) {
+	f := NewFailureBackoff()
+	ip := net.ParseIP("203.0.113.1")
+
+	var delay, last int64
+	for i := 0; i < 1000; i++ {
+		d := f.Fail(ip)
+		delay = int64(d)
+		if delay <= 0 {
+			t.Fatalf("strike %d: delay must stay positive, got %d", i, delay)
+		}
+		if delay < last {
+			t.Fatalf("strike %d: delay must never decrease once strikes keep growing, was %d now %d", i, last, delay)
+		}
+		last = delay
+	}
+
+	if d := f.delayFor(ip); d <= 0 {
+		t.Fatalf("delayFor must stay positive after many strikes, got %d", d)
+	}
+}
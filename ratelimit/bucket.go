@@ -0,0 +1,150 @@
+// Package ratelimit implements per-source connection quotas and
+// GeoIP-aware accept/reject policies. It is invoked from
+// proxy.Server.accept before the expensive obfuscated2 handshake runs,
+// so scanners and abusive sources are turned away as cheaply as
+// possible.
+package ratelimit
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	ipv4PrefixBits = 24
+	ipv6PrefixBits = 64
+
+	bucketGCInterval = 10 * time.Minute
+	bucketIdleTTL    = 30 * time.Minute
+)
+
+// bucket is a simple token bucket: it refills refillPerMinute tokens per
+// minute, spread evenly, up to capacity, and take reports whether a token
+// was available.
+type bucket struct {
+	mu        sync.Mutex
+	tokens    float64
+	capacity  float64
+	refillPS  float64
+	updatedAt time.Time
+	touchedAt time.Time
+}
+
+func newBucket(capacity float64, refillPerMinute float64) *bucket {
+	now := time.Now()
+
+	return &bucket{
+		tokens:    capacity,
+		capacity:  capacity,
+		refillPS:  refillPerMinute / 60,
+		updatedAt: now,
+		touchedAt: now,
+	}
+}
+
+func (b *bucket) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(b.updatedAt).Seconds()
+	b.tokens += elapsed * b.refillPS
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.updatedAt = now
+	b.touchedAt = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
+
+func (b *bucket) idle(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return now.Sub(b.touchedAt) > bucketIdleTTL
+}
+
+// bucketShards is a sharded collection of token buckets keyed by an
+// arbitrary string, with lazy garbage collection of idle entries. It
+// backs both Buckets (keyed by IP prefix) and ASNBuckets (keyed by ASN),
+// which must not share a key space: a quota meant for one must never be
+// looked up, and possibly collide, under a key derived for the other.
+type bucketShards struct {
+	capacity        float64
+	refillPerMinute float64
+
+	shards sync.Map // key string -> *bucket
+
+	lastGC time.Time
+	gcMu   sync.Mutex
+}
+
+func newBucketShards(capacity, refillPerMinute int) *bucketShards {
+	return &bucketShards{
+		capacity:        float64(capacity),
+		refillPerMinute: float64(refillPerMinute),
+		lastGC:          time.Now(),
+	}
+}
+
+func (b *bucketShards) allow(key string) bool {
+	defer b.maybeGC()
+
+	value, _ := b.shards.LoadOrStore(key, newBucket(b.capacity, b.refillPerMinute))
+
+	return value.(*bucket).take()
+}
+
+func (b *bucketShards) maybeGC() {
+	b.gcMu.Lock()
+	defer b.gcMu.Unlock()
+
+	if time.Since(b.lastGC) < bucketGCInterval {
+		return
+	}
+	b.lastGC = time.Now()
+
+	now := time.Now()
+	b.shards.Range(func(key, value interface{}) bool {
+		if value.(*bucket).idle(now) {
+			b.shards.Delete(key)
+		}
+
+		return true
+	})
+}
+
+// Buckets is a collection of token buckets keyed by the /24 (IPv4) or
+// /64 (IPv6) prefix of the source address.
+type Buckets struct {
+	shards *bucketShards
+}
+
+// NewBuckets creates a Buckets instance where each prefix may take up
+// to capacity connections, refilling at refillPerMinute tokens/minute.
+func NewBuckets(capacity int, refillPerMinute int) *Buckets {
+	return &Buckets{shards: newBucketShards(capacity, refillPerMinute)}
+}
+
+// Allow reports whether a connection from ip should be let through.
+func (b *Buckets) Allow(ip net.IP) bool {
+	return b.shards.allow(prefixKey(ip))
+}
+
+func prefixKey(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		mask := net.CIDRMask(ipv4PrefixBits, 32)
+		return v4.Mask(mask).String()
+	}
+
+	mask := net.CIDRMask(ipv6PrefixBits, 128)
+
+	return ip.Mask(mask).String()
+}
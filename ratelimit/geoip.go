@@ -0,0 +1,119 @@
+package ratelimit
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoipCloseDelay is how long Reload waits before closing the database
+// it just replaced, so a Lookup already in flight against it has time
+// to finish instead of reading from an unmapped file.
+const geoipCloseDelay = 30 * time.Second
+
+// GeoIP resolves source addresses to a country ISO code and an ASN
+// using a MaxMind mmdb database. The database is loaded once and can
+// be hot-reloaded (e.g. on SIGHUP) without disrupting lookups that are
+// already in flight.
+type GeoIP struct {
+	reader atomic.Value // holds *maxminddb.Reader
+}
+
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+type asnRecord struct {
+	AutonomousSystemNumber uint `maxminddb:"autonomous_system_number"`
+}
+
+// NewGeoIP opens path and returns a GeoIP ready to be queried.
+func NewGeoIP(path string) (*GeoIP, error) {
+	g := &GeoIP{}
+	if err := g.Reload(path); err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// Reload swaps in the database at path. Lookups racing with Reload see
+// either the old or the new database consistently; none block. The
+// previous database is closed geoipCloseDelay after the swap, once any
+// Lookup that was already in flight against it has had time to return.
+func (g *GeoIP) Reload(path string) error {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return errors.Annotate(err, "Cannot open GeoIP database")
+	}
+
+	old, _ := g.reader.Load().(*maxminddb.Reader)
+	g.reader.Store(reader)
+
+	if old != nil {
+		time.AfterFunc(geoipCloseDelay, func() {
+			old.Close() // nolint: errcheck
+		})
+	}
+
+	return nil
+}
+
+// Country returns the ISO-3166-1 alpha-2 country code for ip, or ""
+// if it cannot be determined.
+func (g *GeoIP) Country(ip net.IP) string {
+	reader, _ := g.reader.Load().(*maxminddb.Reader)
+	if reader == nil {
+		return ""
+	}
+
+	var record geoRecord
+	if err := reader.Lookup(ip, &record); err != nil {
+		return ""
+	}
+
+	return record.Country.ISOCode
+}
+
+// ASN returns the autonomous system number ip belongs to, or 0 if it
+// cannot be determined.
+func (g *GeoIP) ASN(ip net.IP) uint {
+	reader, _ := g.reader.Load().(*maxminddb.Reader)
+	if reader == nil {
+		return 0
+	}
+
+	var record asnRecord
+	if err := reader.Lookup(ip, &record); err != nil {
+		return 0
+	}
+
+	return record.AutonomousSystemNumber
+}
+
+// Allowed reports whether country is permitted given the allow/block
+// lists. An empty allow list means "allow everything not blocked".
+func Allowed(country string, allowed, blocked []string) bool {
+	for _, c := range blocked {
+		if c == country {
+			return false
+		}
+	}
+
+	if len(allowed) == 0 {
+		return true
+	}
+
+	for _, c := range allowed {
+		if c == country {
+			return true
+		}
+	}
+
+	return false
+}
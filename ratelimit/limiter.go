@@ -0,0 +1,145 @@
+package ratelimit
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/9seconds/mtg/config"
+)
+
+// Limiter bundles connection quotas and GeoIP policy into the single
+// check proxy.Server.accept runs before the obfuscated2 handshake.
+// Every field that depends on config values is held behind an
+// atomic.Value so Reload can swap it out without disturbing a check
+// that is already in flight.
+type Limiter struct {
+	conf    atomic.Value // *config.Config
+	perIP   atomic.Value // *Buckets, nil pointer when quotas are disabled
+	perASN  atomic.Value // *ASNBuckets, nil pointer when quotas are disabled
+	geoip   *GeoIP
+	backoff *FailureBackoff
+}
+
+// NewLimiter builds a Limiter from conf. geoip may be nil when
+// conf.UseGeoIP() is false.
+func NewLimiter(conf *config.Config, geoip *GeoIP) *Limiter {
+	l := &Limiter{
+		geoip:   geoip,
+		backoff: NewFailureBackoff(),
+	}
+
+	l.conf.Store(conf)
+	l.perIP.Store(buildBuckets(conf.MaxConnectionsPerIP, conf.MaxHandshakesPerMinutePerIP))
+	l.perASN.Store(buildASNBuckets(conf.MaxConnectionsPerASN, conf.MaxHandshakesPerMinutePerIP))
+
+	return l
+}
+
+// Reload re-derives every quota and the GeoIP database path from conf,
+// replacing them atomically so connections being checked concurrently
+// always see an internally-consistent snapshot, never a half-updated
+// one. The GeoIP database itself is only reopened when GeoIPDatabase
+// actually changed, so a reload that only rotates a secret, e.g. on
+// SIGHUP, does not mmap a fresh copy of an unchanged database.
+func (l *Limiter) Reload(conf *config.Config) error {
+	prevConf, _ := l.conf.Load().(*config.Config)
+
+	if l.geoip != nil && conf.GeoIPDatabase != "" && (prevConf == nil || prevConf.GeoIPDatabase != conf.GeoIPDatabase) {
+		if err := l.geoip.Reload(conf.GeoIPDatabase); err != nil {
+			return errors.Annotate(err, "Cannot reload GeoIP database")
+		}
+	}
+
+	l.perIP.Store(buildBuckets(conf.MaxConnectionsPerIP, conf.MaxHandshakesPerMinutePerIP))
+	l.perASN.Store(buildASNBuckets(conf.MaxConnectionsPerASN, conf.MaxHandshakesPerMinutePerIP))
+	l.conf.Store(conf)
+
+	return nil
+}
+
+func buildBuckets(capacity, refillPerMinute int) *Buckets {
+	if capacity <= 0 {
+		return nil
+	}
+
+	return NewBuckets(capacity, refillPerMinute)
+}
+
+func buildASNBuckets(capacity, refillPerMinute int) *ASNBuckets {
+	if capacity <= 0 {
+		return nil
+	}
+
+	return NewASNBuckets(capacity, refillPerMinute)
+}
+
+// Allow decides whether a new connection from ip should proceed to the
+// handshake. On rejection it returns the reason: "geoip", "per_ip_quota"
+// or "per_asn_quota". proxy.Server.accept counts rejections under
+// mtg_handshake_failures_total; no separate mtg_rejected_total metric is
+// exported.
+func (l *Limiter) Allow(ip net.IP) (bool, string) {
+	conf := l.conf.Load().(*config.Config)
+	perIP, _ := l.perIP.Load().(*Buckets)
+	perASN, _ := l.perASN.Load().(*ASNBuckets)
+
+	if l.geoip != nil && conf.UseGeoIP() {
+		country := l.geoip.Country(ip)
+		if !Allowed(country, conf.AllowedCountries, conf.BlockedCountries) {
+			return false, "geoip"
+		}
+	}
+
+	if perIP != nil && !perIP.Allow(ip) {
+		return false, "per_ip_quota"
+	}
+
+	if perASN != nil && l.geoip != nil {
+		asn := l.geoip.ASN(ip)
+		if asn != 0 && !perASN.Allow(asn) {
+			return false, "per_asn_quota"
+		}
+	}
+
+	return true, ""
+}
+
+// Delay returns how long to wait before responding to ip, based on its
+// history of failed handshakes.
+func (l *Limiter) Delay(ip net.IP) time.Duration {
+	return l.backoff.delayFor(ip)
+}
+
+// HandshakeFailed records that ip's handshake failed, growing its
+// future Delay.
+func (l *Limiter) HandshakeFailed(ip net.IP) {
+	l.backoff.Fail(ip)
+}
+
+// HandshakeSucceeded clears ip's backoff history.
+func (l *Limiter) HandshakeSucceeded(ip net.IP) {
+	l.backoff.Forget(ip)
+}
+
+func (f *FailureBackoff) delayFor(ip net.IP) time.Duration {
+	key := ip.String()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	elem, ok := f.entries[key]
+	if !ok {
+		return 0
+	}
+
+	entry := elem.Value.(*backoffEntry)
+	delay := backoffBase * time.Duration(1<<uint(entry.strikes-1))
+	if delay > backoffMax {
+		delay = backoffMax
+	}
+
+	return delay
+}
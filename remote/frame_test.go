@@ -0,0 +1,50 @@
+package remote
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// TestTokenJSONRoundTrip guards against the signature being embedded as
+// raw bytes in a JSON string field: encoding/json would silently mangle
+// any byte sequence that isn't valid UTF-8, and a ConnectFrame carrying
+// a mangled Token never verifies again on the other side of the wire.
+func TestTokenJSONRoundTrip(t *testing.T) {
+	key := []byte("test-hmac-key")
+	now := time.Now()
+
+	token := Sign(key, "test-nonce", now.Unix())
+
+	payload, err := json.Marshal(ConnectFrame{Token: token})
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	var decoded ConnectFrame
+	if err := json.Unmarshal(payload, &decoded); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+
+	if err := decoded.Token.Verify(key, now); err != nil {
+		t.Fatalf("Verify failed after JSON round trip: %v", err)
+	}
+}
+
+func TestTokenVerifyRejectsWrongKey(t *testing.T) {
+	now := time.Now()
+	token := Sign([]byte("right-key"), "nonce", now.Unix())
+
+	if err := token.Verify([]byte("wrong-key"), now); err == nil {
+		t.Fatal("expected Verify to reject a token signed with a different key")
+	}
+}
+
+func TestTokenVerifyRejectsExpired(t *testing.T) {
+	now := time.Now()
+	token := Sign([]byte("key"), "nonce", now.Add(-2*TokenTTL).Unix())
+
+	if err := token.Verify([]byte("key"), now); err == nil {
+		t.Fatal("expected Verify to reject an expired token")
+	}
+}
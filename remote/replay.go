@@ -0,0 +1,40 @@
+package remote
+
+import (
+	"sync"
+	"time"
+)
+
+// NonceCache remembers nonces seen within TokenTTL so a captured
+// ConnectFrame cannot be replayed against the same back-end. Entries
+// older than TokenTTL are swept lazily on Seen.
+type NonceCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// NewNonceCache creates an empty NonceCache.
+func NewNonceCache() *NonceCache {
+	return &NonceCache{seen: make(map[string]time.Time)}
+}
+
+// Seen returns true and remembers nonce if it was not seen before
+// (within the last TokenTTL). A second call with the same nonce
+// returns false.
+func (c *NonceCache) Seen(nonce string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for n, seenAt := range c.seen {
+		if now.Sub(seenAt) > TokenTTL {
+			delete(c.seen, n)
+		}
+	}
+
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+	c.seen[nonce] = now
+
+	return true
+}
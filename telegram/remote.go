@@ -0,0 +1,150 @@
+package telegram
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+	"go.uber.org/zap"
+
+	"github.com/9seconds/mtg/config"
+	"github.com/9seconds/mtg/mtproto"
+	"github.com/9seconds/mtg/remote"
+)
+
+const (
+	remoteDialTimeout   = 10 * time.Second
+	remoteHealthTimeout = 3 * time.Second
+	remoteHealthPeriod  = 15 * time.Second
+)
+
+// remoteTelegram forwards the decrypted MTPROTO stream to one of the
+// configured back-end mtg nodes instead of dialing Telegram directly.
+// It implements telegram.Telegram so it is a drop-in replacement for
+// NewDirectTelegram/NewMiddleTelegram in NewServer.
+type remoteTelegram struct {
+	conf    *config.Config
+	logger  *zap.SugaredLogger
+	healthy []*atomic.Value // holds bool, indexed like conf.RemoteBackends
+	next    uint32          // round-robin cursor into conf.RemoteBackends, advanced by pickBackend
+}
+
+// NewRemoteTelegram creates a Telegram implementation that tunnels
+// traffic to the back-end nodes listed in conf.RemoteBackends.
+func NewRemoteTelegram(conf *config.Config, logger *zap.SugaredLogger) Telegram {
+	rt := &remoteTelegram{
+		conf:    conf,
+		logger:  logger,
+		healthy: make([]*atomic.Value, len(conf.RemoteBackends)),
+	}
+
+	for i, backend := range conf.RemoteBackends {
+		v := &atomic.Value{}
+		v.Store(true)
+		rt.healthy[i] = v
+
+		go rt.healthcheckLoop(i, backend)
+	}
+
+	return rt
+}
+
+// Dial opens a TLS tunnel to the next healthy back-end (round-robin)
+// and sends the connect frame that authenticates socketID's stream and
+// hands over connOpts for reconstruction on the other side.
+func (r *remoteTelegram) Dial(socketID string, connOpts *mtproto.ConnectionOpts) (io.ReadWriteCloser, error) {
+	backend, idx, err := r.pickBackend()
+	if err != nil {
+		return nil, errors.Annotate(err, "Cannot pick remote backend")
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: remoteDialTimeout}, "tcp", backend.URL, nil)
+	if err != nil {
+		r.healthy[idx].Store(false)
+		return nil, errors.Annotate(err, "Cannot dial remote backend")
+	}
+
+	connOptsJSON, err := json.Marshal(connOpts)
+	if err != nil {
+		conn.Close() // nolint: errcheck
+		return nil, errors.Annotate(err, "Cannot marshal connection options")
+	}
+
+	nonce, err := newNonce()
+	if err != nil {
+		conn.Close() // nolint: errcheck
+		return nil, errors.Annotate(err, "Cannot generate nonce")
+	}
+
+	frame := remote.ConnectFrame{
+		Token:       remote.Sign(backend.HMACKey, nonce, time.Now().Unix()),
+		BearerToken: backend.BearerToken,
+		ConnOpts:    connOptsJSON,
+	}
+	payload, err := json.Marshal(frame)
+	if err != nil {
+		conn.Close() // nolint: errcheck
+		return nil, errors.Annotate(err, "Cannot marshal connect frame")
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(remoteDialTimeout)) // nolint: errcheck
+	err = remote.WriteFrame(conn, payload)
+	conn.SetWriteDeadline(time.Time{}) // nolint: errcheck
+	if err != nil {
+		conn.Close() // nolint: errcheck
+		return nil, errors.Annotate(err, "Cannot send connect frame")
+	}
+
+	return conn, nil
+}
+
+// Init is a no-op for the remote transport: the handshake with
+// Telegram itself already happened on the back-end node.
+func (r *remoteTelegram) Init(connOpts *mtproto.ConnectionOpts, conn io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+	return conn, nil
+}
+
+// pickBackend round-robins across the healthy back-ends, starting from
+// wherever the previous call left off, so load is spread evenly instead
+// of always landing on the first healthy entry.
+func (r *remoteTelegram) pickBackend() (config.RemoteBackend, int, error) {
+	total := len(r.conf.RemoteBackends)
+	start := int(atomic.AddUint32(&r.next, 1)) - 1
+
+	for offset := 0; offset < total; offset++ {
+		i := (start + offset) % total
+		if r.healthy[i].Load().(bool) {
+			return r.conf.RemoteBackends[i], i, nil
+		}
+	}
+
+	return config.RemoteBackend{}, 0, errors.New("no healthy remote backends available")
+}
+
+func (r *remoteTelegram) healthcheckLoop(idx int, backend config.RemoteBackend) {
+	for range time.Tick(remoteHealthPeriod) {
+		conn, err := net.DialTimeout("tcp", backend.URL, remoteHealthTimeout)
+		if err != nil {
+			r.healthy[idx].Store(false)
+			r.logger.Warnw("Remote backend failed health check", "backend", backend.URL, "error", err)
+			continue
+		}
+		conn.Close() // nolint: errcheck
+		r.healthy[idx].Store(true)
+	}
+}
+
+func newNonce() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}